@@ -17,6 +17,11 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 )
 
 var fset = token.NewFileSet()
@@ -31,13 +36,14 @@ func handle(err error) {
 func main() {
 	flag.Parse()
 
-	// parser file
-	file, err := parser.ParseFile(fset, flag.Arg(0), nil, 0)
+	filenames, err := pkgFiles(flag.Args())
 	handle(err)
 
+	pkg := &ast.Package{Name: "pkg", Files: parseFiles(filenames)}
+
 	// rewrite operator method names
-	ast.Apply(file, func(parent ast.Node, name string, index int, n ast.Node) bool {
-		switch n := n.(type) {
+	ast.Apply(pkg, func(c *ast.Cursor) bool {
+		switch n := c.Node().(type) {
 		case *ast.InterfaceType:
 			for _, m := range n.Methods.List {
 				// Correct ASTs can only have one method name here (len(m.Names) == 1),
@@ -59,66 +65,207 @@ func main() {
 		return true
 	}, nil)
 
-	// rewrite operators
-	for progress := true; ; {
-		pkg, tmap, err := typecheck(file)
-		if err == nil || !progress {
-			break
-		}
-		progress = false
-		ast.Apply(file,
-			func(parent ast.Node, name string, index int, n ast.Node) bool {
-				switch n := n.(type) {
+	// rewrite operators, across the whole package at once so that a
+	// call in one file can be resolved against a method declared in
+	// another. Re-type-checking the whole package on every pass is
+	// quadratic in the depth of nested rewrites, so instead we
+	// type-check once up front and thereafter only re-type-check the
+	// expressions a pass actually rewrote (via types.CheckExpr),
+	// merging the results back into tmap; that's enough for the next
+	// pass to see the types of the nodes it just created.
+	tpkg, tmap, err := typecheck(pkg)
+	for err != nil {
+		var changed []ast.Expr
+		ast.Apply(pkg,
+			func(c *ast.Cursor) bool {
+				switch n := c.Node().(type) {
 				case *ast.AssignStmt:
 					if len(n.Lhs) != 1 || len(n.Rhs) != 1 {
 						break // cannot handle these cases yet
 					}
-					if lhs, ok := n.Lhs[0].(*ast.IndexExpr); ok {
-						if r := rewrite(pkg, tmap, lhs.X, "[]=", append(lhs.Index, n.Rhs[0])...); r != nil {
-							ast.SetField(parent, name, index, &ast.ExprStmt{r})
-							progress = true
+					lhs, ok := n.Lhs[0].(*ast.IndexExpr)
+					if !ok {
+						break
+					}
+					if n.Tok == token.ASSIGN {
+						if r := rewrite(tpkg, tmap, lhs.X, "[]=", append(lhs.Index, n.Rhs[0])...); r != nil {
+							c.Replace(&ast.ExprStmt{r})
+							changed = append(changed, r)
 						}
+						break
+					}
+					// compound index assignment: a[i] += x  =>  a.ATSET__(i, a.AT__(i).ADD__(x))
+					op, ok := compoundOp[n.Tok]
+					if !ok {
+						break // cannot handle this operator yet
+					}
+					recvType := tmap[lhs.X].Type
+					get := rewriteType(tpkg, recvType, lhs.X, "[]", lhs.Index...)
+					elem := resultType(tpkg, recvType, "[]")
+					if get == nil || elem == nil {
+						break
+					}
+					val := rewriteType(tpkg, elem, get, op, n.Rhs[0])
+					if val == nil {
+						break
+					}
+					args := append(append([]ast.Expr{}, lhs.Index...), val)
+					if r := rewriteType(tpkg, recvType, lhs.X, "[]=", args...); r != nil {
+						c.Replace(&ast.ExprStmt{r})
+						changed = append(changed, val, r)
 					}
 				}
 				return true
 			},
-			func(parent ast.Node, name string, index int, n ast.Node) bool {
+			func(c *ast.Cursor) bool {
 				var r *ast.CallExpr
-				switch n := n.(type) {
+				switch n := c.Node().(type) {
 				case *ast.IndexExpr:
-					r = rewrite(pkg, tmap, n.X, "[]", n.Index...)
+					r = rewrite(tpkg, tmap, n.X, "[]", n.Index...)
+				case *ast.UnaryExpr:
+					r = rewrite(tpkg, tmap, n.X, "u"+n.Op.String())
 				case *ast.BinaryExpr:
-					r = rewrite(pkg, tmap, n.X, n.Op.String(), n.Y)
+					// covers arithmetic (+ - * / %) as well as comparisons
+					// (== != < <= > >=); rewrite only fires when the
+					// concrete method exists, so e.g. comparing an
+					// interface value against untyped nil is untouched.
+					r = rewrite(tpkg, tmap, n.X, n.Op.String(), n.Y)
+				case *ast.SliceExpr:
+					if n.Low != nil && n.High != nil && !n.Slice3 {
+						r = rewrite(tpkg, tmap, n.X, "[:]", n.Low, n.High)
+					}
 				}
 				if r != nil {
-					ast.SetField(parent, name, index, r)
-					progress = true
+					c.Replace(r)
+					changed = append(changed, r)
 				}
 				return true
 			},
 		)
+		if len(changed) == 0 {
+			break // fixpoint: no rewrite applies anymore
+		}
+		if !updateTypes(tpkg, tmap, changed) {
+			// a rewrite landed somewhere CheckExpr can't resolve on its
+			// own (e.g. at package scope); give up on the incremental
+			// path for this round and recheck the whole package
+			tpkg, tmap, err = typecheck(pkg)
+		}
 	}
 
-	// write AST
-	buf := bytes.NewBuffer([]byte("// +build ignore\n\n")) // don't pollute directory with buildable files
-	handle(format.Node(buf, fset, file))
-	filename := "generated." + flag.Arg(0)
-	handle(ioutil.WriteFile(filename, buf.Bytes(), 0666))
+	// write the rewritten package back out, one file at a time
+	var outs []string
+	for name, file := range pkg.Files {
+		buf := bytes.NewBuffer([]byte("// +build ignore\n\n")) // don't pollute directory with buildable files
+		handle(format.Node(buf, fset, file))
+		out := "generated." + filepath.Base(name)
+		handle(ioutil.WriteFile(out, buf.Bytes(), 0666))
+		outs = append(outs, out)
+	}
 
 	// compile and run
-	out, _ := exec.Command("go", "run", filename).CombinedOutput()
+	out, _ := exec.Command("go", append([]string{"run"}, outs...)...).CombinedOutput()
 	fmt.Printf("%s", out)
 }
 
-func typecheck(file *ast.File) (*types.Package, map[ast.Expr]types.TypeAndValue, error) {
+// pkgFiles resolves the command-line arguments to a list of Go source
+// filenames. A single directory argument expands to the (non-test)
+// .go files it contains, sorted for reproducible output; otherwise
+// the arguments are taken to already be an explicit file list.
+func pkgFiles(args []string) ([]string, error) {
+	if len(args) != 1 {
+		return args, nil
+	}
+	fi, err := os.Stat(args[0])
+	if err != nil || !fi.IsDir() {
+		return args, nil
+	}
+	entries, err := ioutil.ReadDir(args[0])
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go") {
+			files = append(files, filepath.Join(args[0], name))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// parseFiles parses filenames concurrently, the way the compiler's own
+// package loader does: a semaphore sized GOMAXPROCS+10 lets the mostly
+// I/O-bound parses of many files overlap, while keeping at most that
+// many parsing goroutines running at once regardless of package size.
+func parseFiles(filenames []string) map[string]*ast.File {
+	files := make([]*ast.File, len(filenames))
+	errs := make([]error, len(filenames))
+
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0)+10)
+	var wg sync.WaitGroup
+	for i, filename := range filenames {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, filename string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			files[i], errs[i] = parser.ParseFile(fset, filename, nil, 0)
+		}(i, filename)
+	}
+	wg.Wait()
+
+	pkgFiles := make(map[string]*ast.File, len(filenames))
+	for i, filename := range filenames {
+		handle(errs[i])
+		pkgFiles[filename] = files[i]
+	}
+	return pkgFiles
+}
+
+func typecheck(pkg *ast.Package) (*types.Package, map[ast.Expr]types.TypeAndValue, error) {
+	var names []string
+	for name := range pkg.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]*ast.File, len(names))
+	for i, name := range names {
+		files[i] = pkg.Files[name]
+	}
+
 	conf := types.Config{Importer: importer.For("gc", nil), Error: func(error) {}}
 	tmap := make(map[ast.Expr]types.TypeAndValue)
-	pkg, err := conf.Check("pkg", fset, []*ast.File{file}, &types.Info{Types: tmap})
-	return pkg, tmap, err
+	tpkg, err := conf.Check(pkg.Name, fset, files, &types.Info{Types: tmap})
+	return tpkg, tmap, err
+}
+
+// updateTypes type-checks each of the changed expressions - newly
+// built call expressions a previous rewrite pass spliced into the
+// tree - in isolation via types.CheckExpr, merging the result into
+// tmap. It reports whether all of them could be resolved that way;
+// on failure the caller should fall back to a full typecheck.
+func updateTypes(pkg *types.Package, tmap map[ast.Expr]types.TypeAndValue, changed []ast.Expr) bool {
+	info := &types.Info{Types: tmap}
+	for _, e := range changed {
+		if err := types.CheckExpr(fset, pkg, e.Pos(), e, info); err != nil {
+			return false
+		}
+	}
+	return true
 }
 
 func rewrite(pkg *types.Package, tmap map[ast.Expr]types.TypeAndValue, recv ast.Expr, opname string, args ...ast.Expr) *ast.CallExpr {
-	meth, _, _ := types.LookupFieldOrMethod(tmap[recv].Type, false, pkg, methName[opname])
+	return rewriteType(pkg, tmap[recv].Type, recv, opname, args...)
+}
+
+// rewriteType is like rewrite but takes the receiver's type directly,
+// for receivers (e.g. the synthetic a.AT__(i) call built for a compound
+// index assignment) that never went through the type-checker and so
+// have no entry in tmap.
+func rewriteType(pkg *types.Package, typ types.Type, recv ast.Expr, opname string, args ...ast.Expr) *ast.CallExpr {
+	meth, _, _ := types.LookupFieldOrMethod(typ, false, pkg, methName[opname])
 	if _, ok := meth.(*types.Func); !ok {
 		return nil // no method found
 	}
@@ -126,12 +273,46 @@ func rewrite(pkg *types.Package, tmap map[ast.Expr]types.TypeAndValue, recv ast.
 	return &ast.CallExpr{Fun: fun, Args: args}
 }
 
+// resultType returns the result type of the operator method opname on
+// typ, or nil if typ has no such method or it doesn't return exactly
+// one value.
+func resultType(pkg *types.Package, typ types.Type, opname string) types.Type {
+	meth, _, _ := types.LookupFieldOrMethod(typ, false, pkg, methName[opname])
+	fn, ok := meth.(*types.Func)
+	if !ok {
+		return nil
+	}
+	res := fn.Type().(*types.Signature).Results()
+	if res.Len() != 1 {
+		return nil
+	}
+	return res.At(0).Type()
+}
+
 var methName = map[string]string{
 	"+":   "ADD__",
 	"-":   "SUB__",
 	"*":   "MUL__",
 	"/":   "QUO__",
 	"%":   "REM__",
+	"u-":  "NEG__",
+	"u!":  "NOT__",
+	"u^":  "COM__",
+	"==":  "EQ__",
+	"!=":  "NE__",
+	"<":   "LT__",
+	"<=":  "LE__",
+	">":   "GT__",
+	">=":  "GE__",
 	"[]":  "AT__",
 	"[]=": "ATSET__",
+	"[:]": "SLICE__",
+}
+
+var compoundOp = map[token.Token]string{
+	token.ADD_ASSIGN: "+",
+	token.SUB_ASSIGN: "-",
+	token.MUL_ASSIGN: "*",
+	token.QUO_ASSIGN: "/",
+	token.REM_ASSIGN: "%",
 }
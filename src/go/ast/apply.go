@@ -10,25 +10,12 @@ import (
 )
 
 // An ApplyFunc is invoked by Apply for each node n, even if n is nil,
-// before and/or after the node's children.
-//
-// The parent, name, and index arguments identify the parent node's field
-// containing n. If that field is a slice, index identifies the node's position
-// in that slice; index is < 0 otherwise. Roughly speaking, the following
-// invariants hold:
-//
-//   parent.name        == n  if index < 0
-//   parent.name[index] == n  if index >= 0
-//
-// SetField(parent, name, index, n1) can be used to change that field
-// to a different node n1.
-//
-// Exception: If the parent is a *Package, and Apply is iterating
-// through the Files map, name is the filename, and index is -1.
+// before and/or after the node's children, using a Cursor describing
+// the current node and providing operations on it.
 //
 // The return value of ApplyFunc controls the syntax tree traversal.
 // See Apply for details.
-type ApplyFunc func(parent Node, name string, index int, n Node) bool
+type ApplyFunc func(*Cursor) bool
 
 // Apply traverses a syntax tree recursively, starting with root,
 // and calling pre and post for each node as described below. The
@@ -42,50 +29,164 @@ type ApplyFunc func(parent Node, name string, index int, n Node) bool
 // were traversed (post-order). If the result of calling post is false,
 // traversal is terminated and Apply returns immediately.
 //
-// Only fields that refer to AST nodes are considered children.
+// Only fields that refer to AST nodes are considered children;
+// i.e., fields of basic types (strings, []byte, etc.) are ignored.
 // Children are traversed in the order in which they appear in the
-// respective node's struct definition.
+// respective node's struct definition. A package's files are
+// traversed in Package.Files map iteration order, which is not defined.
+//
+// A Cursor describes a node encountered during Apply. Information
+// about the node and its parent is available from the Cursor's
+// accessor methods. See the Cursor documentation for details.
 func Apply(root Node, pre, post ApplyFunc) Node {
+	parent := &struct{ Node }{root}
 	defer func() {
 		if r := recover(); r != nil && r != abort {
 			panic(r)
 		}
 	}()
-	a := &application{root, pre, post}
-	a.apply(a, "Node", -1, a.Node)
-	return a.Node
+	a := &application{pre: pre, post: post}
+	a.apply(parent, "Node", nil, root)
+	return parent.Node
 }
 
-// SetField sets the named field in the parent node to n. If the field
-// is a slice, index is the slice index. The named field must exist in
-// the parent, n must be assignable to that field, and the field must be
-// indexable if index >= 0. In other words, SetField performs the following
-// assignment:
+var abort = new(int) // singleton, to signal abortion of Apply
+
+// A Cursor describes a node encountered during Apply.
+// Information about the node and its parent is available
+// from the Node, Parent, Name, and Index methods.
 //
-//   parent.name        = n  if index < 0
-//   parent.name[index] = n  if index >= 0
+// The methods Replace, Delete, InsertBefore, and InsertAfter
+// can be used to change the AST without disrupting Apply.
+type Cursor struct {
+	parent Node
+	name   string
+	iter   *iterator // valid if non-nil
+	node   Node
+}
+
+// Node returns the current Node.
+func (c *Cursor) Node() Node { return c.node }
+
+// Parent returns the parent of the current Node.
+func (c *Cursor) Parent() Node { return c.parent }
+
+// Name returns the name of the parent Node field that contains the
+// current Node. If the parent is a *Package, and the current Node
+// is a *File, Name is the filename for that File.
+func (c *Cursor) Name() string { return c.name }
+
+// Index reports the index >= 0 of the current Node in the slice of
+// Nodes that contains it, or a value < 0 if the current Node is not
+// part of a slice. The index of the current node changes if
+// InsertBefore is called while processing the current node.
+func (c *Cursor) Index() int {
+	if c.iter != nil {
+		return c.iter.index
+	}
+	return -1
+}
+
+// field returns the current node's parent field value.
+func (c *Cursor) field() reflect.Value {
+	return reflect.Indirect(reflect.ValueOf(c.parent)).FieldByName(c.name)
+}
+
+// Replace replaces the current Node with n. The replacement must
+// match the signature of the field of the parent node that contains
+// the current node.
 //
-// The parent node may be a pointer to the struct containing the named
-// field, or it may be the struct itself.
+// Replace may be called from either pre or post. Apply does not walk
+// n; if Replace is called from pre, Apply goes on to walk the children
+// of the node that was replaced.
 //
-// Exception: If the parent is a Package, n must be a *File and name is
-// interpreted as the filename in the Package.Files map.
-func SetField(parent Node, name string, index int, n Node) {
-	// TODO(gri) This doesn't handle the Package.Files map yet.
-	v := reflect.Indirect(reflect.ValueOf(parent)).FieldByName(name)
-	if index >= 0 {
-		v = v.Index(index)
+// Special case: if the current node's parent is a *Package, name
+// is the filename under which the node (a *File) is keyed in
+// Package.Files, and Replace updates that map entry instead of a
+// struct field.
+func (c *Cursor) Replace(n Node) {
+	if pkg, ok := c.parent.(*Package); ok {
+		pkg.Files[c.name] = n.(*File)
+		return
+	}
+	v := c.field()
+	if i := c.Index(); i >= 0 {
+		v = v.Index(i)
 	}
 	v.Set(reflect.ValueOf(n))
 }
 
+// Delete deletes the current Node from its containing slice.
+// If the current Node is not part of a slice, Delete panics.
+func (c *Cursor) Delete() {
+	if c.iter == nil {
+		panic("Delete node not contained in slice")
+	}
+	i := c.iter.index
+	l := c.field()
+	l.Set(reflect.AppendSlice(l.Slice(0, i), l.Slice(i+1, l.Len())))
+	c.iter.step--
+}
+
+// InsertAfter inserts n after the current Node in its containing
+// slice. If the current Node is not part of a slice, InsertAfter
+// panics. Apply does not walk n.
+func (c *Cursor) InsertAfter(n Node) {
+	if c.iter == nil {
+		panic("InsertAfter node not contained in slice")
+	}
+	i := c.iter.index
+	l := c.field()
+	l.Set(reflect.Append(l, reflect.Zero(l.Type().Elem())))
+	reflect.Copy(l.Slice(i+2, l.Len()), l.Slice(i+1, l.Len()-1))
+	l.Index(i + 1).Set(reflect.ValueOf(n))
+	c.iter.step++
+}
+
+// InsertBefore inserts n before the current Node in its containing
+// slice. If the current Node is not part of a slice, InsertBefore
+// panics. Apply will not walk n if n is inserted while walking the
+// current node in pre-order; n must be walked separately if it needs
+// to be visited.
+func (c *Cursor) InsertBefore(n Node) {
+	if c.iter == nil {
+		panic("InsertBefore node not contained in slice")
+	}
+	i := c.iter.index
+	l := c.field()
+	l.Set(reflect.Append(l, reflect.Zero(l.Type().Elem())))
+	reflect.Copy(l.Slice(i+1, l.Len()), l.Slice(i, l.Len()-1))
+	l.Index(i).Set(reflect.ValueOf(n))
+	c.iter.index++
+}
+
+// iterator controls iteration over a slice-valued field of a node
+// while the slice may be mutated by Delete, InsertBefore, or
+// InsertAfter. index is the position currently being visited; step
+// is added to index once that position's traversal completes, so
+// Delete (step 0) revisits what is now the next element, a plain
+// step (step 1) moves on as usual, and InsertAfter (step 2) skips
+// over the newly inserted sibling.
+type iterator struct {
+	index, step int
+}
+
 type application struct {
-	Node
 	pre, post ApplyFunc
+	cursor    Cursor
+	iter      iterator
 }
 
-func (a *application) apply(parent Node, name string, index int, n Node) {
-	if a.pre != nil && !a.pre(parent, name, index, n) {
+func (a *application) apply(parent Node, name string, iter *iterator, n Node) {
+	// avoid heap-allocating a new cursor for each apply call; reuse a.cursor instead
+	saved := a.cursor
+	a.cursor.parent = parent
+	a.cursor.name = name
+	a.cursor.iter = iter
+	a.cursor.node = n
+
+	if a.pre != nil && !a.pre(&a.cursor) {
+		a.cursor = saved
 		return
 	}
 
@@ -102,23 +203,19 @@ func (a *application) apply(parent Node, name string, index int, n Node) {
 
 	case *CommentGroup:
 		if n != nil {
-			for i, x := range n.List {
-				a.apply(n, "List", i, x)
-			}
+			a.applyList(n, "List")
 		}
 
 	case *Field:
-		a.apply(n, "Doc", -1, n.Doc)
-		a.applyIdentList(n, "Names", n.Names)
-		a.apply(n, "Type", -1, n.Type)
-		a.apply(n, "Tag", -1, n.Tag)
-		a.apply(n, "Comment", -1, n.Comment)
+		a.apply(n, "Doc", nil, n.Doc)
+		a.applyList(n, "Names")
+		a.apply(n, "Type", nil, n.Type)
+		a.apply(n, "Tag", nil, n.Tag)
+		a.apply(n, "Comment", nil, n.Comment)
 
 	case *FieldList:
 		if n != nil {
-			for i, x := range n.List {
-				a.apply(n, "List", i, x)
-			}
+			a.applyList(n, "List")
 		}
 
 	// Expressions
@@ -126,240 +223,243 @@ func (a *application) apply(parent Node, name string, index int, n Node) {
 		// nothing to do
 
 	case *Ellipsis:
-		a.apply(n, "Elt", -1, n.Elt)
+		a.apply(n, "Elt", nil, n.Elt)
 
 	case *FuncLit:
-		a.apply(n, "Type", -1, n.Type)
-		a.apply(n, "Body", -1, n.Body)
+		a.apply(n, "Type", nil, n.Type)
+		a.apply(n, "Body", nil, n.Body)
 
 	case *CompositeLit:
-		a.apply(n, "Type", -1, n.Type)
-		a.applyExprList(n, "Elts", n.Elts)
+		a.apply(n, "Type", nil, n.Type)
+		a.applyList(n, "Elts")
 
 	case *ParenExpr:
-		a.apply(n, "X", -1, n.X)
+		a.apply(n, "X", nil, n.X)
 
 	case *SelectorExpr:
-		a.apply(n, "X", -1, n.X)
-		a.apply(n, "Sel", -1, n.Sel)
+		a.apply(n, "X", nil, n.X)
+		a.apply(n, "Sel", nil, n.Sel)
 
 	case *IndexExpr:
-		a.apply(n, "X", -1, n.X)
-		a.apply(n, "Index", -1, n.Index)
+		a.apply(n, "X", nil, n.X)
+		a.apply(n, "Index", nil, n.Index)
 
 	case *SliceExpr:
-		a.apply(n, "X", -1, n.X)
-		a.apply(n, "Low", -1, n.Low)
-		a.apply(n, "High", -1, n.High)
-		a.apply(n, "Max", -1, n.Max)
+		a.apply(n, "X", nil, n.X)
+		a.apply(n, "Low", nil, n.Low)
+		a.apply(n, "High", nil, n.High)
+		a.apply(n, "Max", nil, n.Max)
 
 	case *TypeAssertExpr:
-		a.apply(n, "X", -1, n.X)
-		a.apply(n, "Type", -1, n.Type)
+		a.apply(n, "X", nil, n.X)
+		a.apply(n, "Type", nil, n.Type)
 
 	case *CallExpr:
-		a.apply(n, "Fun", -1, n.Fun)
-		a.applyExprList(n, "Args", n.Args)
+		a.apply(n, "Fun", nil, n.Fun)
+		a.applyList(n, "Args")
 
 	case *StarExpr:
-		a.apply(n, "X", -1, n.X)
+		a.apply(n, "X", nil, n.X)
 
 	case *UnaryExpr:
-		a.apply(n, "X", -1, n.X)
+		a.apply(n, "X", nil, n.X)
 
 	case *BinaryExpr:
-		a.apply(n, "X", -1, n.X)
-		a.apply(n, "Y", -1, n.Y)
+		a.apply(n, "X", nil, n.X)
+		a.apply(n, "Y", nil, n.Y)
 
 	case *KeyValueExpr:
-		a.apply(n, "Key", -1, n.Key)
-		a.apply(n, "Value", -1, n.Value)
+		a.apply(n, "Key", nil, n.Key)
+		a.apply(n, "Value", nil, n.Value)
 
 	// Types
 	case *ArrayType:
-		a.apply(n, "Len", -1, n.Len)
-		a.apply(n, "Elt", -1, n.Elt)
+		a.apply(n, "Len", nil, n.Len)
+		a.apply(n, "Elt", nil, n.Elt)
 
 	case *StructType:
-		a.apply(n, "Fields", -1, n.Fields)
+		a.apply(n, "Fields", nil, n.Fields)
 
 	case *FuncType:
-		a.apply(n, "Params", -1, n.Params)
-		a.apply(n, "Results", -1, n.Results)
+		a.apply(n, "Params", nil, n.Params)
+		a.apply(n, "Results", nil, n.Results)
 
 	case *InterfaceType:
-		a.apply(n, "Methods", -1, n.Methods)
+		a.apply(n, "Methods", nil, n.Methods)
 
 	case *MapType:
-		a.apply(n, "Key", -1, n.Key)
-		a.apply(n, "Value", -1, n.Value)
+		a.apply(n, "Key", nil, n.Key)
+		a.apply(n, "Value", nil, n.Value)
 
 	case *ChanType:
-		a.apply(n, "Value", -1, n.Value)
+		a.apply(n, "Value", nil, n.Value)
 
 	// Statements
 	case *BadStmt:
 		// nothing to do
 
 	case *DeclStmt:
-		a.apply(n, "Decl", -1, n.Decl)
+		a.apply(n, "Decl", nil, n.Decl)
 
 	case *EmptyStmt:
 		// nothing to do
 
 	case *LabeledStmt:
-		a.apply(n, "Label", -1, n.Label)
-		a.apply(n, "Stmt", -1, n.Stmt)
+		a.apply(n, "Label", nil, n.Label)
+		a.apply(n, "Stmt", nil, n.Stmt)
 
 	case *ExprStmt:
-		a.apply(n, "X", -1, n.X)
+		a.apply(n, "X", nil, n.X)
 
 	case *SendStmt:
-		a.apply(n, "Chan", -1, n.Chan)
-		a.apply(n, "Value", -1, n.Value)
+		a.apply(n, "Chan", nil, n.Chan)
+		a.apply(n, "Value", nil, n.Value)
 
 	case *IncDecStmt:
-		a.apply(n, "X", -1, n.X)
+		a.apply(n, "X", nil, n.X)
 
 	case *AssignStmt:
-		a.applyExprList(n, "Lhs", n.Lhs)
-		a.applyExprList(n, "Rhs", n.Rhs)
+		a.applyList(n, "Lhs")
+		a.applyList(n, "Rhs")
 
 	case *GoStmt:
-		a.apply(n, "Call", -1, n.Call)
+		a.apply(n, "Call", nil, n.Call)
 
 	case *DeferStmt:
-		a.apply(n, "Call", -1, n.Call)
+		a.apply(n, "Call", nil, n.Call)
 
 	case *ReturnStmt:
-		a.applyExprList(n, "Results", n.Results)
+		a.applyList(n, "Results")
 
 	case *BranchStmt:
-		a.apply(n, "Label", -1, n.Label)
+		a.apply(n, "Label", nil, n.Label)
 
 	case *BlockStmt:
-		a.applyStmtList(n, "List", n.List)
+		a.applyList(n, "List")
 
 	case *IfStmt:
-		a.apply(n, "Init", -1, n.Init)
-		a.apply(n, "Cond", -1, n.Cond)
-		a.apply(n, "Body", -1, n.Body)
-		a.apply(n, "Else", -1, n.Else)
+		a.apply(n, "Init", nil, n.Init)
+		a.apply(n, "Cond", nil, n.Cond)
+		a.apply(n, "Body", nil, n.Body)
+		a.apply(n, "Else", nil, n.Else)
 
 	case *CaseClause:
-		a.applyExprList(n, "List", n.List)
-		a.applyStmtList(n, "Body", n.Body)
+		a.applyList(n, "List")
+		a.applyList(n, "Body")
 
 	case *SwitchStmt:
-		a.apply(n, "Init", -1, n.Init)
-		a.apply(n, "Tag", -1, n.Tag)
-		a.apply(n, "Body", -1, n.Body)
+		a.apply(n, "Init", nil, n.Init)
+		a.apply(n, "Tag", nil, n.Tag)
+		a.apply(n, "Body", nil, n.Body)
 
 	case *TypeSwitchStmt:
-		a.apply(n, "Init", -1, n.Init)
-		a.apply(n, "Assign", -1, n.Assign)
-		a.apply(n, "Body", -1, n.Body)
+		a.apply(n, "Init", nil, n.Init)
+		a.apply(n, "Assign", nil, n.Assign)
+		a.apply(n, "Body", nil, n.Body)
 
 	case *CommClause:
-		a.apply(n, "Comm", -1, n.Comm)
-		a.applyStmtList(n, "Body", n.Body)
+		a.apply(n, "Comm", nil, n.Comm)
+		a.applyList(n, "Body")
 
 	case *SelectStmt:
-		a.apply(n, "Body", -1, n.Body)
+		a.apply(n, "Body", nil, n.Body)
 
 	case *ForStmt:
-		a.apply(n, "Init", -1, n.Init)
-		a.apply(n, "Cond", -1, n.Cond)
-		a.apply(n, "Post", -1, n.Post)
-		a.apply(n, "Body", -1, n.Body)
+		a.apply(n, "Init", nil, n.Init)
+		a.apply(n, "Cond", nil, n.Cond)
+		a.apply(n, "Post", nil, n.Post)
+		a.apply(n, "Body", nil, n.Body)
 
 	case *RangeStmt:
-		a.apply(n, "Key", -1, n.Key)
-		a.apply(n, "Value", -1, n.Value)
-		a.apply(n, "X", -1, n.X)
-		a.apply(n, "Body", -1, n.Body)
+		a.apply(n, "Key", nil, n.Key)
+		a.apply(n, "Value", nil, n.Value)
+		a.apply(n, "X", nil, n.X)
+		a.apply(n, "Body", nil, n.Body)
 
 	// Declarations
 	case *ImportSpec:
-		a.apply(n, "Doc", -1, n.Doc)
-		a.apply(n, "Name", -1, n.Name)
-		a.apply(n, "Path", -1, n.Path)
-		a.apply(n, "Comment", -1, n.Comment)
+		a.apply(n, "Doc", nil, n.Doc)
+		a.apply(n, "Name", nil, n.Name)
+		a.apply(n, "Path", nil, n.Path)
+		a.apply(n, "Comment", nil, n.Comment)
 
 	case *ValueSpec:
-		a.apply(n, "Doc", -1, n.Doc)
-		a.applyIdentList(n, "Names", n.Names)
-		a.apply(n, "Type", -1, n.Type)
-		a.applyExprList(n, "Values", n.Values)
-		a.apply(n, "Comment", -1, n.Comment)
+		a.apply(n, "Doc", nil, n.Doc)
+		a.applyList(n, "Names")
+		a.apply(n, "Type", nil, n.Type)
+		a.applyList(n, "Values")
+		a.apply(n, "Comment", nil, n.Comment)
 
 	case *TypeSpec:
-		a.apply(n, "Doc", -1, n.Doc)
-		a.apply(n, "Name", -1, n.Name)
-		a.apply(n, "Type", -1, n.Type)
-		a.apply(n, "Comment", -1, n.Comment)
+		a.apply(n, "Doc", nil, n.Doc)
+		a.apply(n, "Name", nil, n.Name)
+		a.apply(n, "Type", nil, n.Type)
+		a.apply(n, "Comment", nil, n.Comment)
 
 	case *BadDecl:
 		// nothing to do
 
 	case *GenDecl:
-		a.apply(n, "Doc", -1, n.Doc)
-		for i, x := range n.Specs {
-			a.apply(n, "Specs", i, x)
-		}
+		a.apply(n, "Doc", nil, n.Doc)
+		a.applyList(n, "Specs")
 
 	case *FuncDecl:
-		a.apply(n, "Doc", -1, n.Doc)
-		a.apply(n, "Recv", -1, n.Recv)
-		a.apply(n, "Name", -1, n.Name)
-		a.apply(n, "Type", -1, n.Type)
-		a.apply(n, "Body", -1, n.Body)
+		a.apply(n, "Doc", nil, n.Doc)
+		a.apply(n, "Recv", nil, n.Recv)
+		a.apply(n, "Name", nil, n.Name)
+		a.apply(n, "Type", nil, n.Type)
+		a.apply(n, "Body", nil, n.Body)
 
 	// Files and packages
 	case *File:
-		a.apply(n, "Doc", -1, n.Doc)
-		a.apply(n, "Name", -1, n.Name)
-		a.applyDeclList(n, "Decls", n.Decls)
+		a.apply(n, "Doc", nil, n.Doc)
+		a.apply(n, "Name", nil, n.Name)
+		a.applyList(n, "Decls")
 		// don't walk n.Comments - they have been
 		// visited already through the individual
 		// nodes
 
 	case *Package:
 		for name, f := range n.Files {
-			a.apply(n, name, -1, f)
+			a.apply(n, name, nil, f)
 		}
 
 	default:
 		panic(fmt.Sprintf("ast.Apply: unexpected node type %T", n))
 	}
 
-	if a.post != nil && !a.post(parent, name, index, n) {
+	if a.post != nil && !a.post(&a.cursor) {
 		panic(abort)
 	}
-}
-
-var abort = new(int) // singleton, to signal abortion of Apply
 
-func (a *application) applyIdentList(parent Node, name string, list []*Ident) {
-	for i, x := range list {
-		a.apply(parent, name, i, x)
-	}
+	a.cursor = saved
 }
 
-func (a *application) applyExprList(parent Node, name string, list []Expr) {
-	for i, x := range list {
-		a.apply(parent, name, i, x)
-	}
-}
+// applyList applies the traversal to a slice-valued field of parent
+// identified by name. It re-reads the field via reflect after each
+// element is visited, so that Delete, InsertBefore, and InsertAfter
+// performed on the current element are reflected in subsequent
+// iterations.
+func (a *application) applyList(parent Node, name string) {
+	// avoid heap-allocating a new iterator for each applyList call; reuse a.iter instead
+	saved := a.iter
+	a.iter.index = 0
+	for {
+		// must reload parent.name each time, since cursor modifications might change it
+		v := reflect.Indirect(reflect.ValueOf(parent)).FieldByName(name)
+		if a.iter.index >= v.Len() {
+			break
+		}
 
-func (a *application) applyStmtList(parent Node, name string, list []Stmt) {
-	for i, x := range list {
-		a.apply(parent, name, i, x)
-	}
-}
+		// element x may be nil in a bad AST - be cautious
+		var x Node
+		if e := v.Index(a.iter.index); e.IsValid() {
+			x = e.Interface().(Node)
+		}
 
-func (a *application) applyDeclList(parent Node, name string, list []Decl) {
-	for i, x := range list {
-		a.apply(parent, name, i, x)
+		a.iter.step = 1
+		a.apply(parent, name, &a.iter, x)
+		a.iter.index += a.iter.step
 	}
+	a.iter = saved
 }
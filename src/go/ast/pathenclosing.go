@@ -0,0 +1,57 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ast
+
+import (
+	"go/token"
+	"reflect"
+)
+
+// PathEnclosingInterval returns the path to the most tightly enclosing
+// AST node for the source interval [start, end), and whether the
+// interval exactly matched that node's extent. The path is returned
+// leaf-first: path[0] is the innermost node, and the last element is
+// root itself.
+//
+// exact is true if the interval contains no whitespace outside the
+// innermost node's extent, i.e., there is some node n in the result
+// such that n.Pos() == start && n.End() == end.
+//
+// A nil result and false indicate that root does not enclose the
+// interval.
+func PathEnclosingInterval(root Node, start, end token.Pos) (path []Node, exact bool) {
+	Apply(root, func(c *Cursor) bool {
+		n := c.Node()
+		if isNilNode(n) {
+			return false
+		}
+		if n.End() <= start || end <= n.Pos() {
+			return false // [start, end) does not overlap n: prune
+		}
+		if start < n.Pos() || n.End() < end {
+			return false // n only partly covers [start, end), and so do its children: prune
+		}
+		path = append(path, n)
+		if n.Pos() == start && n.End() == end {
+			exact = true
+		}
+		return true
+	}, nil)
+
+	// path was recorded root-first (pre-order); reverse it to be leaf-first.
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, exact
+}
+
+// isNilNode reports whether n is nil, either as an untyped nil or as
+// a typed nil pointer - the latter is common among Apply's optional
+// fields (e.g. a *CommentGroup Doc) and would otherwise panic when
+// Pos or End is called on it.
+func isNilNode(n Node) bool {
+	v := reflect.ValueOf(n)
+	return !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil())
+}